@@ -2,27 +2,34 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"go/build"
-	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 
-	"github.com/kisielk/gotool"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
-	noTestDeps = flag.Bool("T", false, "exclude test dependencies")
-	all        = flag.Bool("a", false, "show all dependencies recursively (only test dependencies from the root packages are shown)")
-	std        = flag.Bool("stdlib", false, "show stdlib dependencies")
-	from       = flag.Bool("from", false, "show which dependencies are introduced by which packages")
-	why        = flag.String("why", "", "show only packages which import directly or indirectly the specified package (implies -a and -from)")
-	files      = flag.Bool("f", false, "list Go source files instead of packages (overrides -from and -why)")
+	noTestDeps       = flag.Bool("T", false, "exclude test dependencies")
+	all              = flag.Bool("a", false, "show all dependencies recursively (only test dependencies from the root packages are shown)")
+	std              = flag.Bool("stdlib", false, "show stdlib dependencies")
+	from             = flag.Bool("from", false, "show which dependencies are introduced by which packages")
+	why              = flag.String("why", "", "show only packages which import directly or indirectly the specified package (implies -a and -from)")
+	whyPath          = flag.Bool("why-path", false, "with -why, print the shortest import chain from each root package to a package matching -why, instead of the usual -why output")
+	files            = flag.Bool("f", false, "list Go source files instead of packages (overrides -from, -why, -m and -json)")
+	jsonOut          = flag.Bool("json", false, "print one JSON object per package instead of plain text")
+	modules          = flag.Bool("m", false, "show module-level dependencies instead of packages")
+	tags             = flag.String("tags", "", "comma-separated list of build tags to apply")
+	goos             = flag.String("goos", "", "target GOOS (defaults to the current GOOS)")
+	goarch           = flag.String("goarch", "", "target GOARCH (defaults to the current GOARCH)")
+	ignore           = flag.String("ignore", "", "comma-separated list of ...-glob patterns to exclude from the output")
+	only             = flag.String("only", "", "comma-separated list of ...-glob patterns; only matching packages are shown")
+	ignoreTransitive = flag.Bool("ignore-transitive", false, "with -ignore, also drop packages that are only reachable through an ignored package")
 )
 
 var whyMatch func(string) bool
@@ -48,10 +55,47 @@ If the package argument to the -why flag is in the standard library,
 the -std flag is implied. The -why flag can also specify Go-command-style
 ... wildcards.
 
+If -why-path is also given, showdeps instead prints, for each root
+package that can reach a package matching -why, the shortest import
+chain between them, one import per indented line, e.g.
+
+	pkg1
+		pkg2
+		pkg3
+
 If the -f flag is provided, instead of packages, showdeps will print
 all the Go source files in the package. It also includes the
 source of the packages specified directly on the command line,
 including their test files unless the -T flag is provided.
+
+If the -m flag is provided, showdeps aggregates the dependencies by
+module instead of by package, printing one module path (or
+path@version) per line. With -from, the modules listed after each
+module are the modules that depend on it. With -why, the pattern is
+matched against module paths and the reverse-edge walk runs over the
+module graph; with -why-path too, the chain printed is the shortest
+path between root and matching modules, not packages. -m has no effect
+with -json, which always reports per-package.
+
+The -tags, -goos and -goarch flags select the build configuration used
+to resolve imports and source files, the same way they would for the go
+command. By default no build tags are added, and GOOS and GOARCH are
+those the go command picks from the environment.
+
+If the -json flag is provided, showdeps prints a JSON array with one
+object per package, with fields ImportPath, Module, Standard, Root,
+Files, Imports and ImportedBy, instead of the plain-text output. Unlike
+the plain and -from output, the packages specified directly on the command
+line are included, with Root set to true; they are still subject to
+-ignore and -only, and their ImportedBy reflects imports from other
+root packages.
+
+The -ignore and -only flags accept comma-separated Go-command-style
+... patterns and prune the packages shown. -ignore drops packages
+matching any of its patterns; -only keeps only packages matching one
+of its patterns. If -ignore-transitive is also given, a package that
+would otherwise be shown only because it was imported by an ignored
+package is dropped too.
 `[1:]
 
 var cwd string
@@ -63,9 +107,9 @@ func main() {
 		os.Exit(2)
 	}
 	flag.Parse()
-	pkgs := flag.Args()
-	if len(pkgs) == 0 {
-		pkgs = []string{"."}
+	patterns := flag.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
 	}
 	if d, err := os.Getwd(); err != nil {
 		log.Fatalf("cannot get working directory: %v", err)
@@ -75,70 +119,114 @@ func main() {
 	if *why != "" {
 		*all = true
 		*from = true
-		if isStdlib(*why) {
+		if !*modules && isStdlib(*why) {
 			*std = true
 		}
 		whyMatch = matchPattern(*why)
 	}
 
-	pkgs = gotool.ImportPaths(pkgs)
+	cfg := &packages.Config{
+		Dir:   cwd,
+		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Tests: !*noTestDeps,
+		Env:   buildEnv(*goos, *goarch),
+	}
+	if *tags != "" {
+		cfg.BuildFlags = []string{"-tags", *tags}
+	}
+	initial, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		log.Fatalf("cannot load packages: %v", err)
+	}
+	if packages.PrintErrors(initial) > 0 {
+		os.Exit(1)
+	}
+
+	pkgsByPath := make(map[string]*packages.Package)
 	rootPkgs := make(map[string]bool)
-	for _, pkg := range pkgs {
-		p, err := build.Default.Import(pkg, cwd, build.FindOnly)
-		if err != nil {
-			log.Fatalf("cannot find %q: %v", pkg, err)
+	var roots []*packages.Package
+	for _, p := range initial {
+		if strings.HasSuffix(p.ID, ".test") {
+			// The synthetic test-binary package; not a real dependency root.
+			continue
+		}
+		roots = append(roots, p)
+		if p.ID != p.PkgPath {
+			// The test-augmented or external-test variant of a root
+			// package. Its imports still need to feed into allPkgs below,
+			// but it isn't a package the user named, and its GoFiles
+			// would double up production/test sources already reached via
+			// the plain variant and testFiles.
+			continue
 		}
-		rootPkgs[p.ImportPath] = true
+		path := pkgPath(p)
+		rootPkgs[path] = true
+		pkgsByPath[path] = p
 	}
 
 	allPkgs := make(map[string][]string)
-	for _, pkg := range pkgs {
-		if err := findImports(pkg, allPkgs, rootPkgs); err != nil {
-			log.Fatalf("cannot find imports from %q: %v", pkg, err)
-		}
-	}
-	if !*files {
-		// Delete packages specified directly on the command line.
-		for pkg := range rootPkgs {
-			delete(allPkgs, pkg)
-		}
-		if whyMatch != nil {
-			// Delete all packages that don't directly or indirectly import *why.
-			marked := make(map[string]bool)
-			for pkg := range allPkgs {
-				if whyMatch(pkg) {
-					markImporters(pkg, allPkgs, marked)
-				}
-			}
-			for pkg := range allPkgs {
-				if !marked[pkg] {
-					delete(allPkgs, pkg)
-				}
-			}
+	seen := make(map[string]bool)
+	for _, p := range roots {
+		findImports(p, allPkgs, pkgsByPath, seen)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if *why != "" && *whyPath && !*files {
+		printWhyPaths(w, rootPkgs, pkgsByPath)
+		return
+	}
+
+	graph := allPkgs
+	keyForMatch := identity
+	if *modules && !*jsonOut && !*files {
+		graph = moduleGraph(allPkgs, pkgsByPath)
+		keyForMatch = modulePath
+	}
+	switch {
+	case *files:
+		// The package graph is printed as-is; files are resolved per
+		// package below.
+	case *jsonOut:
+		// Unlike the plain and -from output, -json reports the root
+		// packages themselves (see below), so their entries must stay
+		// in graph through filtering and pruning to keep their
+		// ImportedBy edges, and their -ignore/-only handling, correct.
+		filterGraph(graph, keyForMatch)
+	default:
+		roots := rootPkgs
+		if *modules {
+			roots = rootModules(rootPkgs, pkgsByPath)
+		}
+		for k := range roots {
+			delete(graph, k)
 		}
+		filterGraph(graph, keyForMatch)
 	}
+	pruneGraph(graph, parsePatterns(*ignore), parsePatterns(*only), *ignoreTransitive, keyForMatch)
 
-	result := make([]string, 0, len(allPkgs))
-	for name := range allPkgs {
+	result := make([]string, 0, len(graph))
+	for name := range graph {
 		result = append(result, name)
 	}
-	w := bufio.NewWriter(os.Stdout)
-	defer w.Flush()
 	sort.Strings(result)
+
+	if *jsonOut && !*files {
+		if err := printJSON(w, result, graph, rootPkgs, pkgsByPath, initial); err != nil {
+			log.Fatalf("cannot encode json: %v", err)
+		}
+		return
+	}
 	for _, r := range result {
 		switch {
 		case *files:
-			pkg, _ := build.Default.Import(r, cwd, 0)
-			showFiles(w, pkg, pkg.GoFiles)
-			showFiles(w, pkg, pkg.CgoFiles)
-			if rootPkgs[pkg.ImportPath] && !*noTestDeps {
-				// It's a package specified directly on the command line.
-				// Show its test files too.
-				showFiles(w, pkg, pkg.TestGoFiles)
-				showFiles(w, pkg, pkg.XTestGoFiles)
+			showFiles(w, pkgsByPath[r].GoFiles)
+			if rootPkgs[r] && !*noTestDeps {
+				showFiles(w, testFiles(r, initial))
 			}
 		case *from:
-			from := allPkgs[r]
+			from := graph[r]
 			sort.Strings(from)
 			from = uniq(from)
 			fmt.Fprintf(w, "%s %s\n", r, strings.Join(from, " "))
@@ -148,12 +236,49 @@ func main() {
 	}
 }
 
-func showFiles(w io.Writer, pkg *build.Package, fs []string) {
+func showFiles(w *bufio.Writer, fs []string) {
 	for _, f := range fs {
-		fmt.Fprintln(w, filepath.Join(pkg.Dir, f))
+		fmt.Fprintln(w, f)
 	}
 }
 
+// testFiles returns the test-only source files (both internal and
+// external test packages) belonging to the root package at path,
+// found among the packages initially loaded.
+func testFiles(path string, initial []*packages.Package) []string {
+	var prod []string
+	var files []string
+	for _, p := range initial {
+		if strings.HasSuffix(p.ID, ".test") {
+			continue
+		}
+		if canonicalRootPath(p) != path {
+			continue
+		}
+		if p.ID == p.PkgPath {
+			prod = p.GoFiles
+			continue
+		}
+		files = append(files, p.GoFiles...)
+	}
+	return subtract(files, prod)
+}
+
+// subtract returns the elements of ss that are not in without.
+func subtract(ss, without []string) []string {
+	skip := make(map[string]bool, len(without))
+	for _, s := range without {
+		skip[s] = true
+	}
+	var result []string
+	for _, s := range ss {
+		if !skip[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 func uniq(ss []string) []string {
 	j := 0
 	prev := ""
@@ -167,6 +292,335 @@ func uniq(ss []string) []string {
 	return ss[0:j]
 }
 
+// filterGraph deletes every entry from graph that doesn't directly or
+// indirectly import a node matching whyMatch. It is a no-op if whyMatch
+// is unset. keyForMatch extracts the part of a graph key that whyMatch
+// should be applied to.
+func filterGraph(graph map[string][]string, keyForMatch func(string) string) {
+	if whyMatch == nil {
+		return
+	}
+	marked := make(map[string]bool)
+	for k := range graph {
+		if whyMatch(keyForMatch(k)) {
+			markImporters(k, graph, marked)
+		}
+	}
+	for k := range graph {
+		if !marked[k] {
+			delete(graph, k)
+		}
+	}
+}
+
+func identity(s string) string { return s }
+
+// parsePatterns splits s on commas and compiles each element with
+// matchPattern. It returns nil if s is empty.
+func parsePatterns(s string) []func(string) bool {
+	if s == "" {
+		return nil
+	}
+	var fns []func(string) bool
+	for _, p := range strings.Split(s, ",") {
+		fns = append(fns, matchPattern(p))
+	}
+	return fns
+}
+
+// matchesAny reports whether any of fns matches name.
+func matchesAny(fns []func(string) bool, name string) bool {
+	for _, f := range fns {
+		if f(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneGraph removes entries from graph that match any of the ignore
+// patterns, or, if only is non-empty, that match none of the only
+// patterns, and strips removed names out of every surviving entry's
+// importer list. keyForMatch extracts the part of a graph key that the
+// patterns should be matched against. If ignoreTransitive is set,
+// entries all of whose importers were ignored (matched an ignore
+// pattern, or were themselves dropped this way) are dropped too,
+// repeating until the graph stops shrinking.
+func pruneGraph(graph map[string][]string, ignore, only []func(string) bool, ignoreTransitive bool, keyForMatch func(string) string) {
+	if len(ignore) == 0 && len(only) == 0 {
+		return
+	}
+	removed := make(map[string]bool)
+	ignored := make(map[string]bool)
+	for k := range graph {
+		name := keyForMatch(k)
+		if matchesAny(ignore, name) {
+			ignored[k] = true
+		}
+		if ignored[k] || (len(only) > 0 && !matchesAny(only, name)) {
+			removed[k] = true
+		}
+	}
+	for k := range removed {
+		delete(graph, k)
+	}
+	// Scrub ignored names out of the surviving importer lists, so an
+	// ignored package doesn't keep showing up as someone's importer.
+	// With -ignore-transitive, also cascade-drop entries left with no
+	// importer at all, repeating until the graph stops shrinking.
+	for changed := true; changed; {
+		changed = false
+		for k, importers := range graph {
+			hadImporters := len(importers) > 0
+			live := importers[:0]
+			for _, imp := range importers {
+				if !ignored[imp] {
+					live = append(live, imp)
+				}
+			}
+			graph[k] = live
+			if ignoreTransitive && hadImporters && len(live) == 0 {
+				ignored[k] = true
+				removed[k] = true
+				delete(graph, k)
+				changed = true
+			}
+		}
+	}
+	// Then scrub the names removed by only.
+	for k, importers := range graph {
+		live := importers[:0]
+		for _, imp := range importers {
+			if !removed[imp] {
+				live = append(live, imp)
+			}
+		}
+		graph[k] = live
+	}
+}
+
+// moduleGraph collapses the per-package import graph allPkgs into a
+// per-module graph, keyed by "path" or "path@version" as reported by
+// the loader.
+func moduleGraph(allPkgs map[string][]string, pkgsByPath map[string]*packages.Package) map[string][]string {
+	mods := make(map[string][]string)
+	for pkg, importers := range allPkgs {
+		p := pkgsByPath[pkg]
+		if p == nil || p.Module == nil {
+			continue
+		}
+		mod := moduleKey(p.Module)
+		mods[mod] = mods[mod] // ensure an entry
+		for _, imp := range importers {
+			impMod := ""
+			if ip := pkgsByPath[imp]; ip != nil && ip.Module != nil {
+				impMod = moduleKey(ip.Module)
+			}
+			if impMod == "" || impMod == mod {
+				continue
+			}
+			mods[mod] = append(mods[mod], impMod)
+		}
+	}
+	return mods
+}
+
+// rootModules returns the modules that rootPkgs belong to.
+func rootModules(rootPkgs map[string]bool, pkgsByPath map[string]*packages.Package) map[string]bool {
+	mods := make(map[string]bool)
+	for path := range rootPkgs {
+		if p := pkgsByPath[path]; p != nil && p.Module != nil {
+			mods[moduleKey(p.Module)] = true
+		}
+	}
+	return mods
+}
+
+// moduleKey formats a module as "path" or, if it has a version,
+// "path@version".
+func moduleKey(m *packages.Module) string {
+	if m.Version == "" {
+		return m.Path
+	}
+	return m.Path + "@" + m.Version
+}
+
+// modulePath strips the "@version" suffix, if any, from a moduleKey
+// result.
+func modulePath(key string) string {
+	if i := strings.IndexByte(key, '@'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// jsonPackage is the schema printed by -json, loosely mirroring
+// `go list -json`.
+type jsonPackage struct {
+	ImportPath string   `json:"ImportPath"`
+	Module     string   `json:"Module,omitempty"`
+	Standard   bool     `json:"Standard,omitempty"`
+	Root       bool     `json:"Root,omitempty"`
+	Files      []string `json:"Files,omitempty"`
+	Imports    []string `json:"Imports,omitempty"`
+	ImportedBy []string `json:"ImportedBy,omitempty"`
+}
+
+// printJSON writes the packages named by names, in order, to w as a
+// single JSON array following the jsonPackage schema.
+func printJSON(w *bufio.Writer, names []string, graph map[string][]string, rootPkgs map[string]bool, pkgsByPath map[string]*packages.Package, initial []*packages.Package) error {
+	out := make([]jsonPackage, 0, len(names))
+	for _, name := range names {
+		jp := jsonPackage{
+			ImportPath: name,
+			Standard:   isStdlib(name),
+			Root:       rootPkgs[name],
+		}
+		if pkg := pkgsByPath[name]; pkg != nil {
+			if pkg.Module != nil {
+				jp.Module = moduleKey(pkg.Module)
+			}
+			jp.Files = append([]string{}, pkg.GoFiles...)
+			for _, imp := range pkg.Imports {
+				jp.Imports = append(jp.Imports, pkgPath(imp))
+			}
+			sort.Strings(jp.Imports)
+		}
+		if jp.Root && !*noTestDeps {
+			jp.Files = append(jp.Files, testFiles(name, initial)...)
+			sort.Strings(jp.Files)
+		}
+		importedBy := append([]string{}, graph[name]...)
+		sort.Strings(importedBy)
+		jp.ImportedBy = uniq(importedBy)
+		out = append(out, jp)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(out)
+}
+
+// printWhyPaths prints, for each root package (or, with -m, root
+// module) that can reach a node matching whyMatch, the shortest import
+// chain between them, one import per indented line.
+func printWhyPaths(w *bufio.Writer, rootPkgs map[string]bool, pkgsByPath map[string]*packages.Package) {
+	fwd := pkgForwardGraph(pkgsByPath)
+	keyForMatch := identity
+	roots := rootPkgs
+	if *modules {
+		fwd = moduleForwardGraph(pkgsByPath)
+		keyForMatch = modulePath
+		roots = rootModules(rootPkgs, pkgsByPath)
+	}
+
+	names := make([]string, 0, len(roots))
+	for r := range roots {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	for _, r := range names {
+		chain := shortestImportChain(r, fwd, keyForMatch)
+		if chain == nil {
+			continue
+		}
+		fmt.Fprintln(w, chain[0])
+		for _, pkg := range chain[1:] {
+			fmt.Fprintln(w, "\t"+pkg)
+		}
+	}
+}
+
+// chainNode is a node in the BFS tree built by shortestImportChain.
+type chainNode struct {
+	path string
+	prev *chainNode
+}
+
+// shortestImportChain returns the shortest chain of identifiers,
+// starting at root, that reaches a node matching whyMatch, found by a
+// breadth-first search over the forward adjacency graph fwd (as built
+// by pkgForwardGraph or moduleForwardGraph). keyForMatch extracts the
+// part of a node identifier that whyMatch should be applied to. It
+// returns nil if no matching node is reachable from root.
+func shortestImportChain(root string, fwd map[string][]string, keyForMatch func(string) string) []string {
+	visited := map[string]bool{root: true}
+	queue := []*chainNode{{path: root}}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if whyMatch(keyForMatch(n.path)) {
+			return chainPath(n)
+		}
+		for _, next := range fwd[n.path] {
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			queue = append(queue, &chainNode{path: next, prev: n})
+		}
+	}
+	return nil
+}
+
+// pkgForwardGraph returns, for every package in pkgsByPath, the distinct
+// import paths it directly imports.
+func pkgForwardGraph(pkgsByPath map[string]*packages.Package) map[string][]string {
+	fwd := make(map[string][]string)
+	for path, p := range pkgsByPath {
+		seen := map[string]bool{path: true}
+		for _, imp := range p.Imports {
+			name := pkgPath(imp)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fwd[path] = append(fwd[path], name)
+		}
+	}
+	return fwd
+}
+
+// moduleForwardGraph returns, for every module that pkgsByPath's
+// packages belong to, the distinct modules directly imported by any
+// package in that module.
+func moduleForwardGraph(pkgsByPath map[string]*packages.Package) map[string][]string {
+	fwd := make(map[string][]string)
+	seen := make(map[string]map[string]bool)
+	for _, p := range pkgsByPath {
+		if p.Module == nil {
+			continue
+		}
+		mod := moduleKey(p.Module)
+		if seen[mod] == nil {
+			seen[mod] = map[string]bool{mod: true}
+		}
+		for _, imp := range p.Imports {
+			if imp.Module == nil {
+				continue
+			}
+			impMod := moduleKey(imp.Module)
+			if seen[mod][impMod] {
+				continue
+			}
+			seen[mod][impMod] = true
+			fwd[mod] = append(fwd[mod], impMod)
+		}
+	}
+	return fwd
+}
+
+// chainPath returns the root-to-n path represented by n's prev chain.
+func chainPath(n *chainNode) []string {
+	var rev []string
+	for ; n != nil; n = n.prev {
+		rev = append(rev, n.path)
+	}
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+	return rev
+}
+
 // markImporters sets a marked entry to true for every entry in allPkgs
 // that is imported by pkg, including pkg itself.
 func markImporters(pkg string, allPkgs map[string][]string, marked map[string]bool) {
@@ -179,50 +633,84 @@ func markImporters(pkg string, allPkgs map[string][]string, marked map[string]bo
 	}
 }
 
+// buildEnv returns the environment in which to run the go command,
+// overriding GOOS and/or GOARCH if goos or goarch are non-empty.
+func buildEnv(goos, goarch string) []string {
+	env := os.Environ()
+	if goos != "" {
+		env = append(env, "GOOS="+goos)
+	}
+	if goarch != "" {
+		env = append(env, "GOARCH="+goarch)
+	}
+	return env
+}
+
 func isStdlib(pkg string) bool {
 	return !strings.Contains(strings.SplitN(pkg, "/", 2)[0], ".")
 }
 
-// findImports recursively adds all imported packages of given
-// package (packageName) to allPkgs map.
-func findImports(packageName string, allPkgs map[string][]string, rootPkgs map[string]bool) error {
-	if packageName == "C" {
-		return nil
+// pkgPath returns pkg's logical import path, stripping any test-variant
+// decoration (such as " [foo.test]") added by the loader.
+func pkgPath(pkg *packages.Package) string {
+	if i := strings.IndexByte(pkg.PkgPath, ' '); i >= 0 {
+		return pkg.PkgPath[:i]
 	}
-	pkg, err := build.Default.Import(packageName, cwd, 0)
-	if err != nil {
-		return fmt.Errorf("cannot find %q: %v", packageName, err)
+	return pkg.PkgPath
+}
+
+// testRootOf returns the import path of the package under test for a
+// test-variant ID such as "pkg [root.test]" or "pkg_test [root.test]",
+// or "" if id doesn't carry that decoration.
+func testRootOf(id string) string {
+	i := strings.IndexByte(id, '[')
+	if i < 0 {
+		return ""
 	}
-	allPkgs[pkg.ImportPath] = allPkgs[pkg.ImportPath] // ensure the package has an entry.
-	for name := range imports(pkg, rootPkgs[pkg.ImportPath]) {
-		if !*std && isStdlib(name) {
-			continue
-		}
-		alreadyDone := allPkgs[name] != nil
-		allPkgs[name] = append(allPkgs[name], pkg.ImportPath)
-		if *all && !alreadyDone {
-			if err := findImports(name, allPkgs, rootPkgs); err != nil {
-				return err
-			}
-		}
+	j := strings.IndexByte(id[i:], ']')
+	if j < 0 {
+		return ""
 	}
-	return nil
+	return strings.TrimSuffix(id[i+1:i+j], ".test")
 }
 
-func imports(pkg *build.Package, isRoot bool) map[string]bool {
-	imps := make(map[string]bool)
-	addPackages(imps, pkg.Imports)
-	if isRoot && !*noTestDeps {
-		addPackages(imps, pkg.TestImports)
-		addPackages(imps, pkg.XTestImports)
+// canonicalRootPath returns the import path that pkg's edges should be
+// attributed to: the package under test for a test-augmented or
+// external-test variant, or pkg's own import path otherwise.
+func canonicalRootPath(pkg *packages.Package) string {
+	if root := testRootOf(pkg.ID); root != "" && (pkgPath(pkg) == root || pkgPath(pkg) == root+"_test") {
+		return root
 	}
-	return imps
+	return pkgPath(pkg)
 }
 
-func addPackages(m map[string]bool, ss []string) {
-	for _, s := range ss {
-		if *std || !isStdlib(s) {
-			m[s] = true
+// findImports recursively adds all imported packages of pkg to allPkgs.
+func findImports(pkg *packages.Package, allPkgs map[string][]string, pkgsByPath map[string]*packages.Package, seen map[string]bool) {
+	if seen[pkg.ID] {
+		return
+	}
+	seen[pkg.ID] = true
+	base := canonicalRootPath(pkg)
+	allPkgs[base] = allPkgs[base] // ensure the package has an entry.
+	for path, imp := range pkg.Imports {
+		if path == "C" {
+			continue
+		}
+		name := pkgPath(imp)
+		if name == base {
+			// The package under test importing itself via its test variant.
+			continue
+		}
+		if !*std && isStdlib(name) {
+			continue
+		}
+		if _, ok := pkgsByPath[name]; !ok {
+			pkgsByPath[name] = imp
+		}
+		alreadyDone := allPkgs[name] != nil
+		allPkgs[name] = append(allPkgs[name], base)
+		if *all && !alreadyDone {
+			findImports(imp, allPkgs, pkgsByPath, seen)
 		}
 	}
 }